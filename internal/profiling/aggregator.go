@@ -0,0 +1,260 @@
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package profiling
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistogram bucketing follows HdrHistogram's scheme: each power-of-two
+// range (an "octave") from 2^exponent to 2^(exponent+1) is itself split into
+// subBucketCount equal-width linear sub-buckets, rather than treated as a
+// single bucket. That bounds the relative error within a bucket to
+// 1/subBucketCount of its value (about 12%) instead of the up-to-2x error a
+// plain power-of-two bucket gives -- the difference that actually matters
+// when a caller asks for p99 and p999 and expects two different numbers
+// back. subBucketBits is deliberately modest (rather than e.g. a "2
+// significant decimal digit" 1/128): a MessageAggregator keeps one
+// latencyHistogram per distinct (StatTag, TimerTag) pair seen in a window
+// (see MessageAggregator.hists below), so histogramBuckets directly sets the
+// per-tag-pair memory cost of every GetAggregatedStats call. exponentBuckets
+// octaves comfortably cover every representable time.Duration.
+const (
+	subBucketBits    = 3
+	subBucketCount   = 1 << subBucketBits
+	exponentBuckets  = 64
+	histogramBuckets = exponentBuckets * subBucketCount
+)
+
+// latencyHistogram is a streaming histogram of wall-clock nanosecond
+// durations, bucketed per the HDR-style scheme described above. Each observe
+// call is O(1), so an arbitrarily long stream of samples folds into a fixed
+// array instead of growing with the number of samples the way a t-digest or
+// a sorted slice would.
+type latencyHistogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+// bucketIndex returns the index of the sub-bucket nanos falls into: the high
+// bits select the octave (via bits.Len64, same as the prior plain
+// power-of-two scheme) and the low bits select the linear sub-bucket within
+// it.
+func bucketIndex(nanos float64) int {
+	if nanos < 1 {
+		return 0
+	}
+
+	exponent := bits.Len64(uint64(nanos)) - 1
+	if exponent >= exponentBuckets {
+		exponent = exponentBuckets - 1
+	}
+
+	base := math.Ldexp(1, exponent)
+	sub := int((nanos/base - 1) * subBucketCount)
+	if sub < 0 {
+		sub = 0
+	} else if sub >= subBucketCount {
+		sub = subBucketCount - 1
+	}
+
+	return exponent*subBucketCount + sub
+}
+
+// bucketUpperBound returns the upper bound of the value range covered by
+// bucket index b, i.e. the value percentile returns for a target rank
+// falling in b.
+func bucketUpperBound(b int) float64 {
+	exponent := b / subBucketCount
+	sub := b % subBucketCount
+	base := math.Ldexp(1, exponent)
+	return base * (1 + float64(sub+1)/subBucketCount)
+}
+
+func (h *latencyHistogram) observe(nanos float64) {
+	if h.count == 0 || nanos < h.min {
+		h.min = nanos
+	}
+	if h.count == 0 || nanos > h.max {
+		h.max = nanos
+	}
+	h.sum += nanos
+	h.count++
+
+	h.counts[bucketIndex(nanos)]++
+}
+
+// percentile estimates the p-th percentile (0-100) by walking buckets in
+// ascending order and returning the upper bound of the bucket containing the
+// target rank. Like any exponential-bucket histogram, this over-estimates,
+// but only by up to 1/subBucketCount of the bucket's value rather than up to
+// 2x, so neighboring high percentiles (e.g. p99 and p999) don't alias onto
+// the same bound.
+func (h *latencyHistogram) percentile(p float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(p / 100 * float64(h.count)))
+	if target == 0 {
+		target = 1
+	}
+
+	var cum uint64
+	for b, c := range h.counts {
+		cum += c
+		if cum >= target {
+			return bucketUpperBound(b)
+		}
+	}
+
+	return h.max
+}
+
+// DefaultAggregationGrace and DefaultAggregationDelay bound how far outside a
+// window's [start, end) a sample's End time may fall and still be accepted,
+// to absorb clock skew and samples that were still in flight when the window
+// closed, without letting arbitrarily old data leak into the window.
+const (
+	DefaultAggregationGrace = 5 * time.Second
+	DefaultAggregationDelay = 5 * time.Second
+)
+
+// aggKey identifies one histogram within a MessageAggregator: the same
+// (StatTag, TimerTag) pair listMessageStat groups by when rendering its
+// indented tree.
+type aggKey struct {
+	statTag  string
+	timerTag string
+}
+
+// AggregatedStat is one row of a MessageAggregator snapshot: summary
+// statistics and the requested percentiles for every Timer sharing a
+// (StatTag, TimerTag) pair within the aggregation window.
+type AggregatedStat struct {
+	StatTag  string
+	TimerTag string
+	Count    uint64
+	SumNanos float64
+	MinNanos float64
+	MaxNanos float64
+	// Percentiles maps a requested percentile (e.g. 99 for p99) to its
+	// estimated wall-nanos value.
+	Percentiles map[float64]float64
+}
+
+// MessageAggregator buckets Timer wall-clock durations into a
+// latencyHistogram per (StatTag, TimerTag), accepting only samples whose End
+// falls within [window start - grace, window end + delay]. Samples outside
+// that range are counted in Dropped rather than silently discarded, so a
+// caller of Snapshot can tell an empty window apart from a window that's
+// losing data to clock skew or a slow collector.
+//
+// A MessageAggregator is meant to be populated with one pass over a batch of
+// Stats (see the profiling service's GetAggregatedStats) and then read once
+// via Snapshot; it is not safe for concurrent use.
+type MessageAggregator struct {
+	window time.Duration
+	grace  time.Duration
+	delay  time.Duration
+
+	start time.Time
+	end   time.Time
+
+	hists map[aggKey]*latencyHistogram
+
+	// Dropped counts samples rejected for falling outside the window's
+	// grace/delay bounds.
+	Dropped atomic.Uint64
+}
+
+// NewMessageAggregator creates a MessageAggregator whose window spans
+// `window` and accepts samples up to `grace` early or `delay` late relative
+// to that window.
+func NewMessageAggregator(window, grace, delay time.Duration) *MessageAggregator {
+	return &MessageAggregator{
+		window: window,
+		grace:  grace,
+		delay:  delay,
+		hists:  make(map[aggKey]*latencyHistogram),
+	}
+}
+
+// Observe folds every Timer in stat into the aggregator, keyed by
+// (stat.StatTag, Timer.TimerTag). now anchors the aggregation window: the
+// first call to Observe sets the window to [now-window, now); Timers whose
+// End falls outside [start-grace, end+delay] are dropped rather than
+// aggregated.
+func (a *MessageAggregator) Observe(stat *Stat, now time.Time) {
+	if stat == nil {
+		return
+	}
+
+	if a.start.IsZero() {
+		a.end = now
+		a.start = now.Add(-a.window)
+	}
+
+	lo := a.start.Add(-a.grace)
+	hi := a.end.Add(a.delay)
+
+	for i := range stat.Timers {
+		timer := &stat.Timers[i]
+		if timer.End.Before(lo) || timer.End.After(hi) {
+			a.Dropped.Add(1)
+			continue
+		}
+
+		key := aggKey{statTag: stat.StatTag, timerTag: timer.TimerTag}
+		h, ok := a.hists[key]
+		if !ok {
+			h = &latencyHistogram{}
+			a.hists[key] = h
+		}
+		h.observe(float64(timer.End.Sub(timer.Begin)))
+	}
+}
+
+// Snapshot returns one AggregatedStat per (StatTag, TimerTag) pair observed
+// so far, each carrying the requested percentiles, in no particular order.
+func (a *MessageAggregator) Snapshot(percentiles []float64) []AggregatedStat {
+	out := make([]AggregatedStat, 0, len(a.hists))
+	for key, h := range a.hists {
+		row := AggregatedStat{
+			StatTag:     key.statTag,
+			TimerTag:    key.timerTag,
+			Count:       h.count,
+			SumNanos:    h.sum,
+			MinNanos:    h.min,
+			MaxNanos:    h.max,
+			Percentiles: make(map[float64]float64, len(percentiles)),
+		}
+		for _, p := range percentiles {
+			row.Percentiles[p] = h.percentile(p)
+		}
+		out = append(out, row)
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package profiling
+
+import "testing"
+
+// TestBucketIndexMonotonic checks that bucketIndex never decreases as nanos
+// increases, and that its upper bound via bucketUpperBound always covers the
+// value that landed in it within the documented 1/subBucketCount error.
+func TestBucketIndexMonotonic(t *testing.T) {
+	prev := -1
+	for nanos := 1.0; nanos < 1e12; nanos *= 1.01 {
+		idx := bucketIndex(nanos)
+		if idx < prev {
+			t.Fatalf("bucketIndex(%v) = %d, expected >= previous index %d", nanos, idx, prev)
+		}
+		prev = idx
+
+		ub := bucketUpperBound(idx)
+		if ub < nanos {
+			t.Fatalf("bucketUpperBound(%d) = %v, expected >= observed value %v", idx, ub, nanos)
+		}
+		if relErr := (ub - nanos) / nanos; relErr > 1.0/subBucketCount {
+			t.Fatalf("value %v: relative error %v exceeds 1/subBucketCount", nanos, relErr)
+		}
+	}
+}
+
+// TestLatencyHistogramPercentiles checks that percentile tells apart two
+// well-separated clusters of samples, which is the property the HDR-style
+// sub-bucketing exists for (a plain power-of-two bucket could alias p99 and
+// p999 onto the same bound even when they fall in clearly different
+// clusters).
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	h := &latencyHistogram{}
+	for i := 0; i < 99000; i++ {
+		h.observe(1000)
+	}
+	for i := 0; i < 1000; i++ {
+		h.observe(10_000_000)
+	}
+
+	if p50 := h.percentile(50); p50 > 2000 {
+		t.Errorf("expected p50 to land in the small cluster, got %v", p50)
+	}
+	if p999 := h.percentile(99.9); p999 < 5_000_000 {
+		t.Errorf("expected p999 to land in the large cluster, got %v", p999)
+	}
+}
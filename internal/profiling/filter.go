@@ -0,0 +1,156 @@
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package profiling
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// FilterRule describes whether profiling should be enabled, and at what
+// sample rate, for RPCs matching a given service and method. "*" in either
+// field matches any service or method, the same wildcard convention used by
+// grpc's binary logging method-logger configuration. Rules are set as a
+// group with SetFilterRules; within that group, a more specific (service,
+// method) pair always takes precedence over a wildcard one, regardless of
+// the order the rules were supplied in.
+type FilterRule struct {
+	Service string
+	Method string
+	Enabled bool
+	SampleRate float64
+}
+
+// filterTable is the compiled form of a []FilterRule: a service map whose
+// values are method maps, so that ShouldProfile can look a (service, method)
+// pair up without scanning the whole rule list on every RPC.
+type filterTable struct {
+	services map[string]map[string]FilterRule
+}
+
+// compileFilterRules validates rules and builds a filterTable out of them.
+// It rejects two rules that target the exact same (service, method) pair,
+// since there would be no well-defined way to decide which one should apply.
+func compileFilterRules(rules []FilterRule) (*filterTable, error) {
+	ft := &filterTable{services: make(map[string]map[string]FilterRule)}
+
+	for _, r := range rules {
+		if r.Service == "" || r.Method == "" {
+			return nil, fmt.Errorf("profiling: filter rule must set both Service and Method (got %+v)", r)
+		}
+		if r.SampleRate < 0 || r.SampleRate > 1 {
+			return nil, fmt.Errorf("profiling: filter rule SampleRate must be within [0, 1] (got %+v)", r)
+		}
+
+		methods, ok := ft.services[r.Service]
+		if !ok {
+			methods = make(map[string]FilterRule)
+			ft.services[r.Service] = methods
+		}
+		if _, ok := methods[r.Method]; ok {
+			return nil, fmt.Errorf("profiling: conflicting filter rules for service %q method %q", r.Service, r.Method)
+		}
+		methods[r.Method] = r
+	}
+
+	return ft, nil
+}
+
+// lookup returns the most specific rule matching (service, method), trying
+// an exact service match before the wildcard service, and within each an
+// exact method match before the wildcard method.
+func (ft *filterTable) lookup(service, method string) (FilterRule, bool) {
+	if ft == nil {
+		return FilterRule{}, false
+	}
+
+	for _, svc := range [...]string{service, "*"} {
+		methods, ok := ft.services[svc]
+		if !ok {
+			continue
+		}
+		for _, m := range [...]string{method, "*"} {
+			if r, ok := methods[m]; ok {
+				return r, true
+			}
+		}
+	}
+
+	return FilterRule{}, false
+}
+
+// rules returns every rule making up ft, in no particular order.
+func (ft *filterTable) rules() []FilterRule {
+	if ft == nil {
+		return nil
+	}
+
+	var out []FilterRule
+	for _, methods := range ft.services {
+		for _, r := range methods {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// currentFilter holds the compiled rule set installed by the most recent
+// call to SetFilterRules, or nil if none has been set (or ClearFilterRules
+// was called since).
+var currentFilter atomic.Pointer[filterTable]
+
+// SetFilterRules replaces the active set of per-service/method filter rules.
+// It returns an error, leaving the previous rules in place, if rules
+// contains an invalid or conflicting entry; see FilterRule and
+// compileFilterRules.
+func SetFilterRules(rules []FilterRule) error {
+	ft, err := compileFilterRules(rules)
+	if err != nil {
+		return err
+	}
+	currentFilter.Store(ft)
+	return nil
+}
+
+// FilterRules returns the currently active filter rules, in no particular
+// order. It returns nil if none are set.
+func FilterRules() []FilterRule {
+	return currentFilter.Load().rules()
+}
+
+// ClearFilterRules removes every active filter rule, reverting ShouldProfile
+// to falling back on the global IsEnabled switch for every service/method.
+func ClearFilterRules() {
+	currentFilter.Store(nil)
+}
+
+// ShouldProfile reports whether a Stat should be created for an RPC on the
+// given service and method, and at what sample rate, by consulting the most
+// specific matching FilterRule. It is meant to be called from the
+// interceptor that creates profiling Stats, once per RPC -- see
+// NewStatForMethod, which does exactly that. If no rule matches -- which is
+// the common case, since most deployments never call SetFilterRules --
+// profiling falls back to the global IsEnabled switch at a sample rate of
+// 1.0.
+func ShouldProfile(service, method string) (enabled bool, sampleRate float64) {
+	if r, ok := currentFilter.Load().lookup(service, method); ok {
+		return r.Enabled, r.SampleRate
+	}
+	return IsEnabled(), 1.0
+}
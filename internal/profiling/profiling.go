@@ -26,14 +26,17 @@
 // example, if one wants to profile the load balancing layer, which is
 // independent of RPC queries, a separate CircularBuffer can be used.
 //
-// Note that the circular buffer simply takes any interface{}. In the future,
-// more types of measurements (such as the number of memory allocations) could
-// be measured, which might require a different type of object being pushed
-// into the circular buffer.
+// Note that the circular buffer simply takes any interface{}. Additional
+// kinds of measurements, such as the number of memory allocations (see
+// Stat.NewAllocTimer), are carried as optional fields on the same Timer type
+// rather than requiring a different object to be pushed into the circular
+// buffer. Stat.NewBlockTimer records only a wall-clock span; no time spent
+// blocked is measured or stored for it.
 
 package profiling
 
 import (
+	"math/rand"
 	"sync/atomic"
 	"runtime"
 	"time"
@@ -41,11 +44,11 @@ import (
 
 // 0 or 1 representing profiling off and on, respectively. Use IsEnabled and
 // SetEnabled to get and set this in a safe manner.
-var profilingEnabled uint32
+var profilingEnabled atomic.Uint32
 
 // IsEnabled returns whether or not profiling is enabled.
 func IsEnabled() bool {
-	return atomic.LoadUint32(&profilingEnabled) > 0
+	return profilingEnabled.Load() > 0
 }
 
 // Enable turns profiling on and off.
@@ -60,12 +63,23 @@ func IsEnabled() bool {
 // SetEnabled is the internal
 func Enable(enabled bool) {
 	if enabled {
-		atomic.StoreUint32(&profilingEnabled, 1)
+		profilingEnabled.Store(1)
 	} else {
-		atomic.StoreUint32(&profilingEnabled, 0)
+		profilingEnabled.Store(0)
 	}
 }
 
+// timerKind distinguishes what a Timer measures, which in turn determines
+// which of Timer's optional fields Egress populates. The zero value,
+// timerKindWall, is the common wall-clock case and touches none of them.
+type timerKind uint8
+
+const (
+	timerKindWall timerKind = iota
+	timerKindAlloc
+	timerKindBlock
+)
+
 // A Timer represents the wall-clock beginning and ending of a logical
 // operation.
 type Timer struct {
@@ -84,6 +98,23 @@ type Timer struct {
 	// trivial patch to the runtime package can make this field useful. See
 	// goid_modified.go in this package for more details.
 	GoID int64
+
+	// AllocDelta is the number of heap objects allocated between NewAllocTimer
+	// and Egress, taken from runtime.MemStats.Mallocs. Only populated for
+	// timers created with NewAllocTimer; zero otherwise.
+	AllocDelta uint64
+	// BytesDelta is the number of bytes allocated between NewAllocTimer and
+	// Egress, taken from runtime.MemStats.TotalAlloc. Only populated for timers
+	// created with NewAllocTimer; zero otherwise.
+	BytesDelta uint64
+
+	// kind records which New*Timer constructor created this Timer, so Egress
+	// knows which of the fields above, if any, to populate.
+	kind timerKind
+	// beginMallocs and beginBytes snapshot runtime.MemStats at NewAllocTimer for
+	// timers with kind == timerKindAlloc; unused otherwise.
+	beginMallocs uint64
+	beginBytes   uint64
 }
 
 // NewTimer creates and returns a new Timer object. This is useful when you
@@ -124,8 +155,8 @@ type Stat struct {
 	// = timerCap at the completion of any given operation; however, since we
 	// can't access len(Timers) and cap(Timers) atomically, we need a timerCap to
 	// keep bookkeeping.
-	timerCap uint32
-	TimerLen uint32
+	timerCap atomic.Uint32
+	TimerLen atomic.Uint32
 	Timers   []Timer
 }
 
@@ -139,20 +170,50 @@ const defaultStatAllocatedTimers uint32 = 64
 
 // NewStat creates and returns a new Stat object.
 func NewStat(statTag string) *Stat {
-	return &Stat{
-		StatTag:  statTag,
-		Timers:   make([]Timer, defaultStatAllocatedTimers),
-		timerCap: defaultStatAllocatedTimers,
+	stat := &Stat{
+		StatTag: statTag,
+		Timers:  make([]Timer, defaultStatAllocatedTimers),
+	}
+	stat.timerCap.Store(defaultStatAllocatedTimers)
+	return stat
+}
+
+// NewStatForMethod is the entry point the interceptor that creates per-RPC
+// Stats is expected to call: it consults ShouldProfile for the given
+// service and method and only allocates a Stat -- applying the matching
+// FilterRule's SampleRate via pseudo-random sampling -- if the RPC should
+// actually be profiled. Like every other Stat-accepting function in this
+// package, a nil *Stat (returned here when the RPC is filtered out or not
+// sampled) is safe to call NewTimer/Egress/etc. on; they become no-ops.
+func NewStatForMethod(service, method, statTag string) *Stat {
+	enabled, sampleRate := ShouldProfile(service, method)
+	if !enabled || !sampled(sampleRate) {
+		return nil
+	}
+	return NewStat(statTag)
+}
+
+// sampled reports whether this particular RPC should be kept, given a
+// FilterRule's SampleRate. Rates outside (0, 1) are handled without
+// consulting the PRNG so that SampleRate: 0 and SampleRate: 1 are exact
+// rather than merely overwhelmingly likely.
+func sampled(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
 	}
+	return rand.Float64() < rate
 }
 
 // getIndex reserves an index on Timers to be used by the caller. Each index is
 // reserved exactly once. If there is no space left in the backing array, it is
 // resized in a lock-free manner.
 func (stat *Stat) getIndex() uint32 {
-	index := atomic.AddUint32(&stat.TimerLen, 1) - 1
+	index := stat.TimerLen.Add(1) - 1
 	for {
-		capacity := atomic.LoadUint32(&stat.timerCap)
+		capacity := stat.timerCap.Load()
 		if index < capacity {
 			break
 		} else if index == capacity {
@@ -160,12 +221,11 @@ func (stat *Stat) getIndex() uint32 {
 			newTimers := make([]Timer, 2*capacity)
 			copy(newTimers[:capacity], stat.Timers[:capacity])
 			stat.Timers = newTimers
-			atomic.StoreUint32(&stat.timerCap, uint32(cap(stat.Timers)))
+			stat.timerCap.Store(uint32(cap(stat.Timers)))
 			break
 		} else {
 			// Somebody else is resizing this array for us. Yield and retry later.
 			runtime.Gosched()
-			capacity = atomic.LoadUint32(&stat.timerCap)
 			continue
 		}
 	}
@@ -195,6 +255,55 @@ func (stat *Stat) NewTimer(timerTag string) uint32 {
 	index := stat.getIndex()
 	stat.Timers[index].TimerTag = timerTag
 	stat.Timers[index].GoID = goid()
+	stat.Timers[index].kind = timerKindWall
+	stat.Timers[index].Begin = time.Now() // do last to capture the actual timer duration more accurately.
+	return index
+}
+
+// NewAllocTimer behaves like NewTimer, except that the Egress call matching
+// the returned index also computes the number of heap objects and bytes
+// allocated over the timer's lifetime (via runtime.MemStats.Mallocs and
+// TotalAlloc) into AllocDelta and BytesDelta. Because it snapshots
+// runtime.MemStats at both ends, it is significantly more expensive than a
+// plain NewTimer and should be used sparingly, e.g. around a specific
+// allocation-heavy step rather than an entire RPC.
+func (stat *Stat) NewAllocTimer(timerTag string) uint32 {
+	if stat == nil {
+		return 0
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	index := stat.getIndex()
+	stat.Timers[index].TimerTag = timerTag
+	stat.Timers[index].GoID = goid()
+	stat.Timers[index].kind = timerKindAlloc
+	stat.Timers[index].beginMallocs = ms.Mallocs
+	stat.Timers[index].beginBytes = ms.TotalAlloc
+	stat.Timers[index].Begin = time.Now() // do last to capture the actual timer duration more accurately.
+	return index
+}
+
+// NewBlockTimer behaves exactly like NewTimer -- Begin/End still carry the
+// timer's plain wall-clock span -- except that it tags the resulting Timer
+// with timerKindBlock, marking it as a span expected to spend time blocked on
+// a mutex, channel, or similar. That mark is kept in an unexported field, so
+// it is not visible outside this package and is not carried into the wire
+// format or the exporters. The
+// runtime doesn't expose a way to attribute runtime/pprof's block-profile
+// samples to an arbitrary span of code (short of a runtime patch, the same
+// caveat as GoID above), so this intentionally doesn't claim to carry a real
+// block-profile sample; it's wall-clock duration with a label.
+func (stat *Stat) NewBlockTimer(timerTag string) uint32 {
+	if stat == nil {
+		return 0
+	}
+
+	index := stat.getIndex()
+	stat.Timers[index].TimerTag = timerTag
+	stat.Timers[index].GoID = goid()
+	stat.Timers[index].kind = timerKindBlock
 	stat.Timers[index].Begin = time.Now() // do last to capture the actual timer duration more accurately.
 	return index
 }
@@ -209,9 +318,18 @@ func (stat *Stat) Egress(index uint32) {
 	// (but not before the stat == nil check; we don't want to affect performance
 	// when profiling is disabled).
 	t := time.Now()
-	if index < atomic.LoadUint32(&stat.TimerLen) {
-		stat.Timers[index].End = t
+	if index >= stat.TimerLen.Load() {
+		return
+	}
+
+	timer := &stat.Timers[index]
+	if timer.kind == timerKindAlloc {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		timer.AllocDelta = ms.Mallocs - timer.beginMallocs
+		timer.BytesDelta = ms.TotalAlloc - timer.beginBytes
 	}
+	timer.End = t
 }
 
 // AppendTimer appends a given Timer object to the internal slice of timers. A
@@ -231,17 +349,17 @@ func (stat *Stat) AppendTimer(timer *Timer) uint32 {
 // ServerConnectionCounter counts the number of connections a server has seen.
 // This counter is embedded within a StreamStat's Metadata along with each
 // stream's stream ID to uniquely identify a query. Accessed atomically.
-var ServerConnectionCounter uint64
+var ServerConnectionCounter atomic.Uint64
 
 // ClientConnectionCounter counts the number of connections a client has
 // initiated. This counter is embedded within a StreamStat's Metadata along
 // with each stream's stream ID to uniquely identify a query. Accessed
 // atomically.
-var ClientConnectionCounter uint64
+var ClientConnectionCounter atomic.Uint64
 
 // statsInitialized is 0 before InitStats has been called. Changed to 1 by
 // exactly one call to InitStats.
-var statsInitialized int32
+var statsInitialized atomic.Int32
 
 // Stats for the last defaultStreamStatsBufsize RPCs will be stored in memory.
 // This is can be configured by the registering server at profiling service
@@ -258,7 +376,7 @@ var StreamStats *circularBuffer
 // once per lifetime of a process; calls after the first one are ignored.
 func InitStats(streamStatsSize uint32) error {
 	var err error
-	if !atomic.CompareAndSwapInt32(&statsInitialized, 0, 1) {
+	if !statsInitialized.CompareAndSwap(0, 1) {
 		// If initialized, do nothing.
 		return nil
 	}
@@ -1,19 +1,34 @@
 package profiling
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 	"runtime"
+	_ "unsafe" // for go:linkname
 )
 
+// runtime_procPin pins the calling goroutine to its current P, returning the
+// P's id, and must be paired with a call to runtime_procUnpin. It is used
+// purely to pick a shard with good locality; the goroutine is unpinned again
+// immediately afterwards, so, much like sync.Pool's per-P pools, the
+// assignment is a best-effort hint rather than a hard guarantee -- the
+// runtime's asynchronous preemption can still migrate a goroutine to another
+// P between two calls to Push.
+//go:linkname runtime_procPin sync.runtime_procPin
+func runtime_procPin() int
+
+//go:linkname runtime_procUnpin sync.runtime_procUnpin
+func runtime_procUnpin()
+
 type circularBufferQueue struct {
 	arr      []unsafe.Pointer
 	size     uint32
 	mask     uint32
-	acquired uint32
-	written  uint32
-	drainingPostCheck uint32
+	acquired atomic.Uint32
+	written  atomic.Uint32
+	drainingPostCheck atomic.Uint32
 }
 
 // Allocates and returns a circularBufferQueue.
@@ -22,58 +37,179 @@ func NewCircularBufferQueue(size uint32) (*circularBufferQueue) {
 		arr: make([]unsafe.Pointer, size),
 		size: size,
 		mask: size - 1,
-		acquired: 0,
-		written: 0,
 	}
 }
 
 // Used by the drainer to block till all pushes to the queue are complete
 // before returns. This condition is not met as long as acquired != written.
 func (q *circularBufferQueue) drainWait() {
-	for atomic.LoadUint32(&q.acquired) != atomic.LoadUint32(&q.written) {
+	for q.acquired.Load() != q.written.Load() {
 		runtime.Gosched()
 		continue
 	}
 }
 
+// circularBufferShard holds the pair of queues backing a single shard of a
+// CircularBuffer. Keeping two queues per shard (instead of one) is what lets
+// Drain swap the shard's write target out from under concurrent pushers
+// without holding them up: drainWait only ever waits on the queue being
+// retired, never on the one new pushes are landing in.
+type circularBufferShard struct {
+	qs [2]*circularBufferQueue
+	qc atomic.Uint32
+
+	// cond is signalled whenever this shard's active queue is reset by a
+	// Drain, so that a PolicyBlock pusher parked in Push can wake up and
+	// retry against the now-empty queue.
+	cond *sync.Cond
+
+	// drainGen counts how many times a Drain has reset this shard. A
+	// PolicyBlock pusher snapshots drainGen before releasing its reservation
+	// and re-checks it under cond.L before calling Wait, so that a Drain
+	// landing in the gap between the two isn't a lost wakeup -- see Push.
+	drainGen atomic.Uint64
+}
+
+func newCircularBufferShard(size uint32) *circularBufferShard {
+	return &circularBufferShard{
+		qs: [2]*circularBufferQueue{
+			NewCircularBufferQueue(size),
+			NewCircularBufferQueue(size),
+		},
+		cond: sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// Switches the shard's current queue for future pushes to proceed to the
+// other queue so that there's no blocking. Assumes mutual exclusion across
+// all drainers, however; this mutual exclusion is guaranteed by the mutex
+// obtained by Drain at the start of execution.
+//
+// Returns a reference to the old queue.
+func (sh *circularBufferShard) switchQueues() (*circularBufferQueue) {
+	if !sh.qc.CompareAndSwap(0, 1) {
+		sh.qc.CompareAndSwap(1, 0)
+		return sh.qs[1]
+	} else {
+		return sh.qs[0]
+	}
+}
+
+// Policy controls what a CircularBuffer does when a shard wraps around on a
+// writer that hasn't been drained yet.
+type Policy int
+
+const (
+	// PolicyOverwrite is the historical, default behavior: a push that wraps
+	// around an undrained slot simply overwrites it, and ordering information
+	// about what got overwritten is lost.
+	PolicyOverwrite Policy = iota
+	// PolicyDropNewest refuses to overwrite an undrained slot; the new value
+	// is discarded instead, and CircularBuffer.Dropped is incremented.
+	PolicyDropNewest
+	// PolicyBlock parks the pushing goroutine until a Drain makes room, giving
+	// lossless collection at the cost of backpressuring writers. Intended for
+	// test scenarios and other low-throughput uses, not hot paths.
+	PolicyBlock
+)
+
+// seqItem wraps a pushed value with a monotonically increasing sequence
+// number, assigned once per CircularBuffer regardless of which shard the
+// value lands in. This is what lets Drain return a single, strictly ordered
+// slice even though writers race across many shards and each shard may wrap
+// independently.
+type seqItem struct {
+	seq uint64
+	val interface{}
+}
+
 // A circular buffer can store up to size elements (the most recent size
-// elements, to be specific). A fixed size buffer is used so that there are no
-// allocation costs at runtime.
+// elements under PolicyOverwrite, to be specific) per shard. A fixed size buffer is used so that
+// there are no allocation costs at runtime.
 //
 // size, mask and written are unsigned because we do some bitwise operations
 // with them. 32 bits because it's more than sufficient; we're not going to
 // store more than 4e9 elements in the circular buffer.
+//
+// CircularBuffer is internally sharded, with one circularBufferShard per
+// GOMAXPROCS, so that concurrent Push calls from different Ps don't hammer
+// the same acquired/written counters. This was previously a single pair of
+// queues shared by every caller, which made Push a contention hotspot under
+// high goroutine counts (see BenchmarkCircularBuffer at high routine counts).
 type CircularBuffer struct {
 	mu sync.Mutex
-	// TODO: multiple queues to decrease write contention on acquired and written?
-	qs []*circularBufferQueue
-	qc uint32
+	shards []*circularBufferShard
+	policy Policy
+	nextSeq atomic.Uint64
+
+	// Dropped counts the number of Push calls that either hit the
+	// queue-switch race below, or were discarded by PolicyDropNewest, and
+	// gave up on writing their value rather than overwriting live data or
+	// blocking. Callers can watch this to notice backpressure instead of
+	// silently losing writes.
+	Dropped atomic.Uint64
 }
 
 // Allocates a circular buffer of size size and returns a reference to the
 // struct. Only circular buffers of size 2^k are allowed (saves us from having
-// to do expensive modulo operations).
+// to do expensive modulo operations). Equivalent to
+// NewCircularBufferWithPolicy(size, PolicyOverwrite).
 func NewCircularBuffer(size uint32) *CircularBuffer {
+	return NewCircularBufferWithPolicy(size, PolicyOverwrite)
+}
+
+// NewCircularBufferWithPolicy is like NewCircularBuffer, but lets the caller
+// pick what happens when a shard wraps around a slot that hasn't been
+// drained yet. See the Policy constants for the available behaviors.
+func NewCircularBufferWithPolicy(size uint32, policy Policy) *CircularBuffer {
 	if size & (size - 1) != 0 {
 		return nil
 	}
 
-	return &CircularBuffer{
-		qs: []*circularBufferQueue{
-			NewCircularBufferQueue(size),
-			NewCircularBufferQueue(size),
-		},
+	numShards := runtime.GOMAXPROCS(0)
+	if numShards < 1 {
+		numShards = 1
 	}
+
+	shards := make([]*circularBufferShard, numShards)
+	for i := range shards {
+		shards[i] = newCircularBufferShard(size)
+	}
+
+	return &CircularBuffer{shards: shards, policy: policy}
 }
 
-// Pushes an element in to the circular buffer.
-func (cb *CircularBuffer) Push(x interface{}) {
-	qc := atomic.LoadUint32(&cb.qc)
-	q := cb.qs[qc]
+// pickShard returns the shard that the calling goroutine should push to. It
+// uses the current P's id as a locality hint: a goroutine that isn't being
+// migrated across Ps (the common case in a tight loop) will keep landing on
+// the same shard, which is what actually eliminates the counter contention.
+func (cb *CircularBuffer) pickShard() *circularBufferShard {
+	pid := runtime_procPin()
+	runtime_procUnpin()
+	return cb.shards[pid % len(cb.shards)]
+}
+
+// maxQueueSwitchRetries bounds the drainingPostCheck retry loop in
+// acquireSlot below. A queue switch only ever flips the active queue at most
+// once per Drain call, so in practice a single retry always suffices; the
+// bound just keeps a pathological run of back-to-back Drains from spinning
+// Push forever.
+const maxQueueSwitchRetries = 8
 
-	acquired := atomic.AddUint32(&q.acquired, 1) - 1
+// acquireSlot reserves a slot on sh's currently active queue, retrying if a
+// concurrent Drain is in the middle of switching queues out from under us.
+// The returned acquired count is only meaningful when ok is true.
+func (sh *circularBufferShard) acquireSlot() (q *circularBufferQueue, acquired uint32, ok bool) {
+	for attempt := 0; attempt < maxQueueSwitchRetries; attempt++ {
+		qc := sh.qc.Load()
+		q = sh.qs[qc]
+
+		acquired = q.acquired.Add(1) - 1
+
+		if q.drainingPostCheck.Load() == 0 {
+			return q, acquired, true
+		}
 
-	if atomic.LoadUint32(&q.drainingPostCheck) > 0 {
 		// Between our qc load and acquired increment, a drainer began execution
 		// and switched the queues. This is NOT okay because we don't know if
 		// acquired was incremented before or after the drainer's check for
@@ -82,15 +218,71 @@ func (cb *CircularBuffer) Push(x interface{}) {
 		// after, we cannot write to this buffer as the drainer's collection may
 		// have already started; we must write to the other queue.
 		//
-		// Reverse our increment and retry. Since there's no SubUint32 in atomic,
-		// ^uint32(0) is used to denote -1.
-		// atomic.AddUint32(&q.acquired, ^uint32(0))
+		// Reverse our increment (otherwise it leaks forever, and the next
+		// drainWait on this queue would block on acquired never catching up to
+		// written) and retry against whatever queue is active now.
+		q.acquired.Add(^uint32(0))
+	}
+
+	return nil, 0, false
+}
+
+// Pushes an element in to the circular buffer.
+func (cb *CircularBuffer) Push(x interface{}) {
+	sh := cb.pickShard()
+	item := seqItem{seq: cb.nextSeq.Add(1) - 1, val: x}
+
+	for {
+		q, acquired, ok := sh.acquireSlot()
+		if !ok {
+			// Every retry raced with a drainer; rather than spin indefinitely,
+			// drop this value and let the caller observe it via Dropped.
+			cb.Dropped.Add(1)
+			return
+		}
+
+		if cb.policy != PolicyOverwrite && acquired >= q.size {
+			// Snapshot drainGen before releasing our reservation below, so we
+			// can tell under cond.L whether a Drain has already reset this
+			// shard by the time we get there.
+			gen := sh.drainGen.Load()
+
+			// We've wrapped around a slot that hasn't been drained yet. Release
+			// our reservation -- we're not writing to it under either policy.
+			q.acquired.Add(^uint32(0))
+
+			if cb.policy == PolicyDropNewest {
+				cb.Dropped.Add(1)
+				return
+			}
+
+			// PolicyBlock: wait for the next Drain to reset this shard, then
+			// retry against whatever is active afterwards. Re-checking drainGen
+			// under cond.L instead of calling Wait unconditionally is what
+			// prevents a concurrent Drain's Broadcast, landing in the gap
+			// between releasing our reservation above and taking the lock
+			// here, from being missed -- a plain Wait would then park this
+			// goroutine until some later, unrelated Drain (or forever, if none
+			// ever comes).
+			sh.cond.L.Lock()
+			for sh.drainGen.Load() == gen {
+				sh.cond.Wait()
+			}
+			sh.cond.L.Unlock()
+			continue
+		}
+
+		writeSlot(q, acquired, item)
 		return
 	}
+}
 
-	// At this point, we're definitely writing to the right queue. Either no
-	// drainer is in execution or is waiting at the acquired == written barrier.
-	// TODO: mask only if acquired >= size?
+// writeSlot stores item at acquired's position in q.
+//
+// At this point, we're definitely writing to the right queue. Either no
+// drainer is in execution or is waiting at the acquired == written barrier.
+// TODO: mask only if acquired >= size?
+func writeSlot(q *circularBufferQueue, acquired uint32, item seqItem) {
 	index := acquired & q.mask
 	addr := &q.arr[index]
 	old := atomic.LoadPointer(addr)
@@ -140,54 +332,83 @@ func (cb *CircularBuffer) Push(x interface{}) {
 	// now fail, thanks to C's successful write. As a result, B will
 	// correctly exit with a simple increment to the written counter without
 	// touching the buffer itself.
-	atomic.CompareAndSwapPointer(addr, old, unsafe.Pointer(&x))
-	atomic.AddUint32(&q.written, 1)
+	atomic.CompareAndSwapPointer(addr, old, unsafe.Pointer(&item))
+	q.written.Add(1)
 }
 
-// Switches the current queue for future pushes to proceed to the other queue
-// so that there's no blocking. Assumes mutual exclusion across all drainers,
-// however; this mutual exclusion is guaranteed by the mutex obtained by Drain
-// at the start of execution.
-//
-// Returns a reference to the old queue.
-func (cb *CircularBuffer) switchQueues() (*circularBufferQueue) {
-	if !atomic.CompareAndSwapUint32(&cb.qc, 0, 1) {
-		atomic.CompareAndSwapUint32(&cb.qc, 1, 0)
-		return cb.qs[1]
+// drainShard retires sh's currently active queue, appends everything it
+// holds to items, and wakes up any PolicyBlock pushers waiting on sh.
+func drainShard(sh *circularBufferShard, items []seqItem) []seqItem {
+	q := sh.switchQueues()
+	q.drainWait()
+	q.drainingPostCheck.Store(1)
+
+	written := q.written.Load()
+	if written < q.size {
+		for i := uint32(0); i < written; i++ {
+			items = append(items, *(*seqItem)(q.arr[i]))
+		}
 	} else {
-		return cb.qs[0]
+		cur := written & q.mask
+		for i := cur; i < q.size; i++ {
+			items = append(items, *(*seqItem)(q.arr[i]))
+		}
+		for i := uint32(0); i < cur; i++ {
+			items = append(items, *(*seqItem)(q.arr[i]))
+		}
 	}
+
+	q.drainingPostCheck.Store(0)
+	q.acquired.Store(0)
+	q.written.Store(0)
+
+	sh.drainGen.Add(1)
+
+	sh.cond.L.Lock()
+	sh.cond.Broadcast()
+	sh.cond.L.Unlock()
+
+	return items
 }
 
-// Allocates and returns an array of things pushed in to the circular buffer.
-func (cb *CircularBuffer) Drain() (result []interface{}) {
+// Allocates and returns an array of things pushed in to the circular buffer,
+// strictly ordered by push sequence number regardless of which shard (and
+// therefore which wrap) each value landed in.
+func (cb *CircularBuffer) Drain() []interface{} {
+	return cb.drainUpTo(-1)
+}
+
+// DrainN behaves like Drain but stops sweeping shards once at least max
+// elements have been collected (or every shard has been swept, whichever
+// comes first), which is useful for bounded snapshot exports that shouldn't
+// pay for a full sweep: shards that aren't needed to reach max are left
+// undrained rather than swept and discarded. max is a lower bound on what
+// gets returned, not a hard cap -- once a shard is swept, every element it
+// held is kept, since a shard can't be partially drained without losing
+// track of what's still live in it; the returned slice can therefore be
+// longer than max by up to one shard's worth of elements. A negative max
+// means unbounded, same as Drain.
+func (cb *CircularBuffer) DrainN(max int) []interface{} {
+	return cb.drainUpTo(max)
+}
+
+func (cb *CircularBuffer) drainUpTo(max int) []interface{} {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
-	q := cb.switchQueues()
-	q.drainWait()
-	atomic.StoreUint32(&q.drainingPostCheck, 1)
-
-	if q.written < q.size {
-		result = make([]interface{}, q.written)
-		for i := uint32(0); i < q.written; i++ {
-			result[i] = *(*interface{})(q.arr[i])
-		}
-	} else {
-		result = make([]interface{}, q.size)
-		cur := q.written & q.mask
-		j := uint32(0)
-		for i := cur; i < q.size; i, j = i+1, j+1 {
-			result[j] = *(*interface{})(q.arr[i])
-		}
-		for i := uint32(0); i < cur; i, j = i+1, j+1 {
-			result[j] = *(*interface{})(q.arr[i])
+	var items []seqItem
+	for _, sh := range cb.shards {
+		if max >= 0 && len(items) >= max {
+			break
 		}
+		items = drainShard(sh, items)
 	}
 
-	atomic.StoreUint32(&q.drainingPostCheck, 0)
-	q.acquired = 0
-	q.written = 0
+	sort.Slice(items, func(i, j int) bool { return items[i].seq < items[j].seq })
 
-	return
+	result := make([]interface{}, len(items))
+	for i, it := range items {
+		result[i] = it.val
+	}
+	return result
 }
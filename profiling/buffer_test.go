@@ -4,10 +4,15 @@ import (
 	"testing"
 	"sync"
 	"fmt"
+	"runtime"
 	"time"
 )
 
 func TestCircularBufferSerial(t *testing.T) {
+	// Pin to a single shard so that serial pushes from this one goroutine are
+	// guaranteed to land in write order; see CircularBuffer's doc comment.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
 	var size, i uint32
 	var result []interface{}
 
@@ -56,6 +61,8 @@ func TestCircularBufferSerial(t *testing.T) {
 }
 
 func TestCircularBufferOverflow(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
 	var size, i, expected uint32
 	var result []interface{}
 
@@ -127,8 +134,9 @@ func TestCircularBufferConcurrent(t *testing.T) {
 
 		// Can't expect the buffer to be full if the pushes aren't necessarily done.
 		if tn == 0 {
-			if uint32(len(result)) != size {
-				t.Errorf("expected drain size to be a full %d, got %d", size, len(result))
+			capacity := size * uint32(len(cb.shards))
+			if uint32(len(result)) != capacity {
+				t.Errorf("expected drain size to be a full %d (size * shards), got %d", capacity, len(result))
 				return
 			}
 		}
@@ -171,6 +179,265 @@ func TestCircularBufferConcurrent(t *testing.T) {
 	}
 }
 
+func TestCircularBufferDrainN(t *testing.T) {
+	var size uint32 = 1 << 6
+	cb := NewCircularBuffer(size)
+	if cb == nil {
+		t.Errorf("expected circular buffer to be allocated, got nil")
+		return
+	}
+
+	// Fill every shard well past capacity from real concurrent goroutines, so
+	// that whichever shard(s) DrainN happens to sweep first are already full
+	// on their own.
+	var wg sync.WaitGroup
+	for r := 0; r < 64; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := uint32(0); n < size; n++ {
+				cb.Push(n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(cb.shards) < 2 {
+		t.Skip("need more than one shard to exercise DrainN's partial sweep")
+	}
+
+	// max is a lower bound, not an exact count: the one shard DrainN sweeps to
+	// reach it is full on its own (every shard was pushed past capacity
+	// above), so every element that shard held must come back, not just the
+	// first 10 swept in seq order.
+	result := cb.DrainN(10)
+	if uint32(len(result)) != size {
+		t.Errorf("expected DrainN(10) to return a full shard's worth (%d), got %d", size, len(result))
+	}
+
+	// DrainN must stop sweeping shards as soon as it has enough elements;
+	// shards it never touched still hold their data, so a Drain right after
+	// must come back with the rest rather than empty.
+	if remainder := cb.Drain(); len(remainder) == 0 {
+		t.Errorf("expected untouched shards to still hold data after DrainN, got an empty drain")
+	}
+}
+
+func TestCircularBufferDropped(t *testing.T) {
+	size := uint32(1 << 6)
+	cb := NewCircularBuffer(size)
+	if cb == nil {
+		t.Errorf("expected circular buffer to be allocated, got nil")
+		return
+	}
+
+	if cb.Dropped.Load() != 0 {
+		t.Errorf("expected Dropped to start at 0")
+	}
+
+	// Pushing without ever draining must never panic or corrupt state, even
+	// if the buffer wraps many times over.
+	for i := uint32(0); i < 4*size; i++ {
+		cb.Push(i)
+	}
+	cb.Drain()
+}
+
+// TestCircularBufferQueueSwitchRace hammers Push and Drain concurrently on a
+// tiny buffer so that queue switches happen constantly, which is what
+// exercises the acquired-rollback path in Push. Run with -race; it asserts
+// that drainWait never deadlocks (acquired must always catch up to written,
+// i.e. no acquired increment is ever leaked on the drop path) by bounding the
+// test's runtime with a context-free timeout via a done channel.
+func TestCircularBufferQueueSwitchRace(t *testing.T) {
+	size := uint32(1 << 4)
+	cb := NewCircularBuffer(size)
+	if cb == nil {
+		t.Errorf("expected circular buffer to be allocated, got nil")
+		return
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					cb.Push(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		cb.Drain()
+	}
+	close(done)
+	wg.Wait()
+
+	// One final drain must complete without drainWait spinning forever; if
+	// acquired were ever leaked by a dropped push, this would hang.
+	drained := make(chan struct{})
+	go func() {
+		cb.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Errorf("final Drain did not complete; acquired/written likely desynced")
+	}
+}
+
+func TestCircularBufferPolicyDropNewest(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	var size uint32 = 1 << 4
+	cb := NewCircularBufferWithPolicy(size, PolicyDropNewest)
+	if cb == nil {
+		t.Errorf("expected circular buffer to be allocated, got nil")
+		return
+	}
+
+	for i := uint32(0); i < 2*size; i++ {
+		cb.Push(i)
+	}
+
+	if got := cb.Dropped.Load(); got != uint64(size) {
+		t.Errorf("expected Dropped to be %d, got %d", size, got)
+	}
+
+	result := cb.Drain()
+	if uint32(len(result)) != size {
+		t.Errorf("expected drain size to be %d, got %d", size, len(result))
+		return
+	}
+
+	// Unlike PolicyOverwrite, the first size values pushed must survive
+	// untouched; the rest were refused rather than overwriting them.
+	for i := uint32(0); i < size; i++ {
+		if result[i] != i {
+			t.Errorf("expected result[%d] to be %d, got %d", i, i, result[i])
+		}
+	}
+}
+
+func TestCircularBufferPolicyBlock(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	var size uint32 = 1 << 4
+	cb := NewCircularBufferWithPolicy(size, PolicyBlock)
+	if cb == nil {
+		t.Errorf("expected circular buffer to be allocated, got nil")
+		return
+	}
+
+	for i := uint32(0); i < size; i++ {
+		cb.Push(i)
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		cb.Push(size) // must block until the Drain below makes room.
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Errorf("expected blocked push not to complete before a Drain")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	result := cb.Drain()
+	if uint32(len(result)) != size {
+		t.Errorf("expected first drain size to be %d, got %d", size, len(result))
+	}
+
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("blocked push did not complete after Drain made room")
+		return
+	}
+
+	if cb.Dropped.Load() != 0 {
+		t.Errorf("expected Dropped to be 0 under PolicyBlock, got %d", cb.Dropped.Load())
+	}
+
+	result = cb.Drain()
+	if len(result) != 1 || result[0] != size {
+		t.Errorf("expected second drain to contain only the unblocked push, got %v", result)
+	}
+}
+
+// TestCircularBufferPolicyBlockRacingDrains guards against a lost wakeup: a
+// PolicyBlock pusher must not miss a Drain's Broadcast just because that
+// Drain runs in the gap between the pusher releasing its reservation and
+// parking on the condition variable. Unlike TestCircularBufferPolicyBlock,
+// which only ever has one Drain in flight, this hammers many blocked
+// pushers against a steady stream of Drains so that some pusher is very
+// likely to hit that gap on every run; before the fix, that pusher would
+// wait for some later, unrelated Drain instead of the very next one, and
+// this test would time out under -race.
+func TestCircularBufferPolicyBlockRacingDrains(t *testing.T) {
+	// Unlike TestCircularBufferPolicyBlock, this test wants real parallelism
+	// between the pusher and drainer goroutines below to have a chance of
+	// hitting the race window, so it doesn't pin GOMAXPROCS(1).
+
+	var size uint32 = 1 << 4
+	cb := NewCircularBufferWithPolicy(size, PolicyBlock)
+	if cb == nil {
+		t.Errorf("expected circular buffer to be allocated, got nil")
+		return
+	}
+
+	stop := make(chan struct{})
+	var drainWg sync.WaitGroup
+	drainWg.Add(1)
+	go func() {
+		defer drainWg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cb.Drain()
+			}
+		}
+	}()
+
+	var pushWg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		pushWg.Add(1)
+		go func() {
+			defer pushWg.Done()
+			for n := uint32(0); n < size; n++ {
+				cb.Push(n)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pushWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("blocked pushes did not all complete; a Drain's wakeup was likely lost")
+	}
+
+	close(stop)
+	drainWg.Wait()
+}
+
 func BenchmarkCircularBuffer(b *testing.B) {
 	for size := 1 << 16; size <= 1 << 20; size <<= 1 {
 		for routines := 1; routines <= 1 << 8; routines <<= 2 {
@@ -2,9 +2,12 @@ package main
 
 import (
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"io"
+	"path/filepath"
 	"context"
 	"fmt"
 	"flag"
@@ -20,38 +23,78 @@ import (
 var address = flag.String("address", "", "address of your remote target")
 var timeout = flag.Int("timeout", 0, "network operations timeout in seconds to remote target (0 indicates unlimited)")
 
+var addresses = flag.String("addresses", "", "comma-separated list of host:port remote targets to fan out to concurrently (mutually exclusive with -address)")
+var targetsFile = flag.String("targets-file", "", "file with one host:port remote target per line to fan out to concurrently (mutually exclusive with -address/-addresses)")
+var concurrency = flag.Int("concurrency", 8, "max number of -addresses/-targets-file targets to dial and fetch from concurrently")
+var mergeSnapshotsFlag = flag.String("merge-snapshots", "", "comma-separated list of local snapshot files to merge offline, tagged by filename, instead of contacting a remote target")
+
 var storeSnapshotFile = flag.String("store-snapshot", "", "connect to remote target and store a profiling snapshot locally for offline processing")
+var snapshotFormat = flag.String("format", "pb", "format to write -store-snapshot in: \"pb\" (default, self-describing streaming protobuf) or \"gob\" (legacy, deprecated; -load-snapshot still auto-detects and reads it)")
 
 var enable = flag.Bool("enable", false, "enable profiling in remote target")
 var disable = flag.Bool("disable", false, "disable profiling in remote target")
 
+var setFilter = flag.String("set-filter", "", "comma-separated list of service:method:enabled:samplerate rules to install in remote target, e.g. '*:*:false:0,foo.Bar:*:true:1,foo.Bar:Baz:true:0.01'; service and method must always be given, use '*' for wildcard; implies -enable unless -enable or -disable is also given")
+var showFilter = flag.Bool("show-filter", false, "show the filter rules currently installed in remote target")
+
 var loadSnapshotFile = flag.String("load-snapshot", "", "load a local profiling snapshot for offline processing")
 var listAll = flag.Bool("list-all", false, "list profiles of all kinds raw")
 var listMessages = flag.Bool("list-messages", false, "list message profiles raw")
 var showPercent = flag.Bool("show-percent", false, "show percent of overall for timer components")
 var messageFilter = flag.String("message-filter", "", "filter for message stats of this type")
 
+var exportPprof = flag.String("export-pprof", "", "write the snapshot out as a gzip-compressed pprof profile, openable with `go tool pprof` or speedscope.app")
+var exportTrace = flag.String("export-trace", "", "write the snapshot out as Chrome trace event format JSON, openable in chrome://tracing or Perfetto")
+
+var aggregate = flag.Bool("aggregate", false, "call GetAggregatedStats on the remote target instead of fetching raw per-RPC stats")
+var aggWindow = flag.Duration("window", 30*time.Second, "aggregation window for -aggregate, e.g. 30s or 5m")
+var aggPercentiles = flag.String("percentiles", "50,90,99", "comma-separated percentiles to compute for -aggregate")
+
+var exportOTLP = flag.String("export-otlp", "", "push the snapshot as OTLP spans to this OTLP/gRPC collector endpoint, e.g. localhost:4317")
+var exportOTLPFile = flag.String("export-otlp-file", "", "write the snapshot as OTLP ExportTraceServiceRequest JSON to this file")
+
 func parseArgs() error {
 	flag.Parse()
 
-	if *address == "" && *loadSnapshotFile == "" {
-		return fmt.Errorf("you must provide either -address or -load-snapshot")
+	sources := 0
+	for _, s := range []string{*address, *addresses, *targetsFile, *loadSnapshotFile, *mergeSnapshotsFlag} {
+		if s != "" {
+			sources++
+		}
 	}
-
-	if *address != "" && *loadSnapshotFile != "" {
-		return fmt.Errorf("you may not provide both -address and -load-snapshot")
+	if sources == 0 {
+		return fmt.Errorf("you must provide one of -address, -addresses, -targets-file, -load-snapshot, or -merge-snapshots")
+	}
+	if sources > 1 {
+		return fmt.Errorf("you may only provide one of -address, -addresses, -targets-file, -load-snapshot, or -merge-snapshots")
 	}
 
 	if *enable && *disable {
 		return fmt.Errorf("you may not -enable and -disable profiling in a remote target at the same time")
 	}
 
-	if *address == "" {
-		if *enable || *disable || *storeSnapshotFile != "" {
-			return fmt.Errorf("cannot do that with a local snapshot file, need a remote target")
+	if *snapshotFormat != "pb" && *snapshotFormat != "gob" {
+		return fmt.Errorf("-format must be \"pb\" or \"gob\", got %q", *snapshotFormat)
+	}
+
+	fanout := *addresses != "" || *targetsFile != ""
+
+	if fanout && *aggregate {
+		return fmt.Errorf("-aggregate is not supported with -addresses/-targets-file")
+	}
+
+	if *address == "" && !fanout {
+		if *enable || *disable || *storeSnapshotFile != "" || *setFilter != "" || *showFilter || *aggregate {
+			return fmt.Errorf("-enable/-disable/-set-filter/-show-filter/-aggregate need a single remote target, not a local snapshot")
 		}
-	} else {
-		if !*enable && !*disable && *storeSnapshotFile == "" {
+	}
+
+	if fanout && (*enable || *disable || *setFilter != "" || *showFilter) {
+		return fmt.Errorf("-enable/-disable/-set-filter/-show-filter need a single -address, not -addresses/-targets-file")
+	}
+
+	if *address != "" {
+		if !*enable && !*disable && *storeSnapshotFile == "" && *setFilter == "" && !*showFilter && *exportPprof == "" && *exportTrace == "" && *exportOTLP == "" && *exportOTLPFile == "" && !*aggregate {
 			return fmt.Errorf("what should I do after connecting to the remote target?")
 		}
 	}
@@ -71,23 +114,130 @@ func setEnabled(ctx context.Context, c pspb.ProfilingClient, enabled bool) {
 	}
 }
 
-type snapshot struct {
-	MessageStats []*profiling.Stat
+// parseFilterRules parses the -set-filter flag's comma-separated
+// service:method:enabled:samplerate rules into proto form.
+func parseFilterRules(spec string) ([]*pspb.FilterRule, error) {
+	var rules []*pspb.FilterRule
+
+	for _, entry := range strings.Split(spec, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("rule %q must have exactly 4 colon-separated fields (service:method:enabled:samplerate)", entry)
+		}
+
+		enabled, err := strconv.ParseBool(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid enabled value %q: %v", entry, fields[2], err)
+		}
+
+		sampleRate, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid samplerate value %q: %v", entry, fields[3], err)
+		}
+
+		rules = append(rules, &pspb.FilterRule{
+			Service: fields[0],
+			Method: fields[1],
+			Enabled: enabled,
+			SampleRate: sampleRate,
+		})
+	}
+
+	return rules, nil
 }
 
-func storeSnapshot(ctx context.Context, c pspb.ProfilingClient, f string) {
-	grpclog.Infof("creating %s", f)
-	file, err := os.Create(f)
+func setFilterRules(ctx context.Context, c pspb.ProfilingClient, spec string) {
+	rules, err := parseFilterRules(spec)
 	if err != nil {
-		grpclog.Errorf("cannot create %s: %v", f, err)
+		grpclog.Errorf("error parsing -set-filter: %v", err)
+		return
+	}
+
+	// -set-filter implies -enable unless the caller explicitly asked to
+	// disable or enable profiling itself; configuring sampling without
+	// turning profiling on would otherwise be a silent no-op.
+	enabled := *enable || !*disable
+
+	resp, err := c.SetEnabled(ctx, &pspb.SetEnabledRequest{Enabled: enabled, Rules: rules})
+	if err != nil {
+		grpclog.Printf("error calling SetEnabled: %v\n", err)
+		return
+	}
+
+	if resp.Success {
+		grpclog.Printf("successfully installed %d filter rule(s)", len(rules))
+	}
+}
+
+func showFilterRules(ctx context.Context, c pspb.ProfilingClient) {
+	resp, err := c.GetEnabledRules(ctx, &pspb.GetEnabledRulesRequest{})
+	if err != nil {
+		grpclog.Printf("error calling GetEnabledRules: %v\n", err)
+		return
+	}
+
+	for _, r := range resp.Rules {
+		fmt.Printf("%s:%s:%v:%v\n", r.Service, r.Method, r.Enabled, r.SampleRate)
+	}
+}
+
+// parsePercentiles parses the -percentiles flag's comma-separated list of
+// numbers (e.g. "50,90,99") into float64s for GetAggregatedStatsRequest.
+func parsePercentiles(spec string) ([]float64, error) {
+	var percentiles []float64
+
+	for _, entry := range strings.Split(spec, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentile %q: %v", entry, err)
+		}
+		percentiles = append(percentiles, p)
+	}
+
+	return percentiles, nil
+}
+
+func showAggregatedStats(ctx context.Context, c pspb.ProfilingClient, window time.Duration, percentileSpec string) {
+	percentiles, err := parsePercentiles(percentileSpec)
+	if err != nil {
+		grpclog.Errorf("error parsing -percentiles: %v", err)
 		return
 	}
 
+	resp, err := c.GetAggregatedStats(ctx, &pspb.GetAggregatedStatsRequest{
+		WindowSeconds: int64(window.Seconds()),
+		Percentiles: percentiles,
+	})
+	if err != nil {
+		grpclog.Printf("error calling GetAggregatedStats: %v\n", err)
+		return
+	}
+
+	for _, row := range resp.Rows {
+		fmt.Printf("%s\t%s\tcount=%d\tsum=%.0fns\tmin=%.0fns\tmax=%.0fns", row.StatTag, row.TimerTag, row.Count, row.SumNanos, row.MinNanos, row.MaxNanos)
+		for _, pv := range row.Percentiles {
+			fmt.Printf("\tp%v=%.0fns", pv.Percentile, pv.ValueNanos)
+		}
+		fmt.Printf("\n")
+	}
+
+	if resp.Dropped > 0 {
+		grpclog.Infof("%d sample(s) fell outside the aggregation window and were dropped", resp.Dropped)
+	}
+}
+
+type snapshot struct {
+	MessageStats []*profiling.Stat
+}
+
+// fetchSnapshot calls GetMessageStats on the remote target and collects the
+// resulting stream into a snapshot, for either storeSnapshot to persist or
+// process to act on directly.
+func fetchSnapshot(ctx context.Context, c pspb.ProfilingClient) (*snapshot, error) {
 	grpclog.Infof("making RPC call to retrieve message stats from remote target")
 	stream, err := c.GetMessageStats(ctx, &pspb.GetMessageStatsRequest{})
 	if err != nil {
-		grpclog.Errorf("error calling GetMessageStats: %v\n", err)
-		return
+		return nil, fmt.Errorf("error calling GetMessageStats: %v", err)
 	}
 
 	s := &snapshot{MessageStats: make([]*profiling.Stat, 0)}
@@ -101,22 +251,213 @@ func storeSnapshot(ctx context.Context, c pspb.ProfilingClient, f string) {
 		}
 
 		if err != nil {
-			grpclog.Errorf("error recv: %v", err)
-			return
+			return nil, fmt.Errorf("error recv: %v", err)
 		}
 
 		stat := proto.StatProtoToStat(resp)
 		s.MessageStats = append(s.MessageStats, stat)
 	}
 
-	grpclog.Infof("writing to %s", f)
-	encoder := gob.NewEncoder(file)
-	encoder.Encode(s)
+	return s, nil
+}
+
+// writeSnapshotFile writes s to f in *snapshotFormat. target identifies the
+// data's origin and is only recorded in the "pb" format's header.
+func writeSnapshotFile(f, target string, s *snapshot) error {
+	file, err := os.Create(f)
+	if err != nil {
+		return fmt.Errorf("cannot create %s: %v", f, err)
+	}
+	defer file.Close()
+
+	switch *snapshotFormat {
+	case "pb":
+		err = proto.WriteSnapshotStream(file, target, s.MessageStats)
+	case "gob":
+		err = gob.NewEncoder(file).Encode(s)
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot write snapshot to %s: %v", f, err)
+	}
+
+	return nil
+}
+
+func storeSnapshot(ctx context.Context, c pspb.ProfilingClient, f string) {
+	s, err := fetchSnapshot(ctx, c)
+	if err != nil {
+		grpclog.Errorf("%v", err)
+		return
+	}
+
+	grpclog.Infof("writing to %s in %s format", f, *snapshotFormat)
+	if err := writeSnapshotFile(f, *address, s); err != nil {
+		grpclog.Errorf("%v", err)
+		return
+	}
 
-	file.Close()
 	grpclog.Infof("successfully wrote profiling snapshot to %s", f)
 }
 
+// parseTargets resolves the -addresses/-targets-file flags into a list of
+// host:port targets to fan out to.
+func parseTargets() ([]string, error) {
+	var targets []string
+
+	if *addresses != "" {
+		for _, t := range strings.Split(*addresses, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				targets = append(targets, t)
+			}
+		}
+		return targets, nil
+	}
+
+	data, err := os.ReadFile(*targetsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", *targetsFile, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+
+	return targets, nil
+}
+
+// defaultFanoutDialTimeout bounds how long fetchTarget's blocking dial --
+// just the dial, not the stats fetch that follows it -- waits for an
+// unreachable fan-out target when -timeout is left at its default of 0
+// ("unlimited"). Unlike the single-target -address path, which dials lazily
+// via grpc.Dial and so never blocks, fetchTarget dials with WithBlock so
+// that a dead target surfaces as a dial error fetchFanout can count as
+// failed, rather than hanging on a connection that never comes up; without
+// some bound, "unlimited" would make that wait forever and the whole
+// fan-out would never complete.
+const defaultFanoutDialTimeout = 10 * time.Second
+
+// fetchTarget dials a single target and fetches its message stats, tagging
+// every resulting Stat's StatTag with a "target|" prefix so a merged
+// snapshot can still be attributed back to where it came from.
+func fetchTarget(ctx context.Context, target string) ([]*profiling.Stat, error) {
+	dialTimeout := defaultFanoutDialTimeout
+	if *timeout > 0 {
+		dialTimeout = time.Duration(*timeout) * time.Second
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	cc, err := grpc.DialContext(dialCtx, target, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %v", err)
+	}
+	defer cc.Close()
+
+	// The dial's own deadline has served its purpose once DialContext
+	// returns. The stats fetch uses ctx, not dialCtx, with a deadline of its
+	// own when -timeout is non-zero; an -timeout of 0 ("unlimited") means the
+	// stats fetch itself has no deadline, only the dial does.
+	fetchCtx := ctx
+	if *timeout > 0 {
+		var fetchCancel context.CancelFunc
+		fetchCtx, fetchCancel = context.WithTimeout(ctx, time.Duration(*timeout)*time.Second)
+		defer fetchCancel()
+	}
+	s, err := fetchSnapshot(fetchCtx, pspb.NewProfilingClient(cc))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stat := range s.MessageStats {
+		stat.StatTag = target + "|" + stat.StatTag
+	}
+
+	return s.MessageStats, nil
+}
+
+// fetchFanout fetches message stats from every target concurrently, bounded
+// by -concurrency, and merges the results into one snapshot. It logs a
+// summary of how many targets succeeded vs failed rather than aborting the
+// whole fan-out over one bad target.
+func fetchFanout(ctx context.Context, targets []string) *snapshot {
+	type result struct {
+		target string
+		stats  []*profiling.Stat
+		err    error
+	}
+
+	results := make(chan result, len(targets))
+	sem := make(chan struct{}, *concurrency)
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			stats, err := fetchTarget(ctx, target)
+			results <- result{target: target, stats: stats, err: err}
+		}(target)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	s := &snapshot{MessageStats: make([]*profiling.Stat, 0)}
+	succeeded, failed := 0, 0
+
+	for r := range results {
+		if r.err != nil {
+			grpclog.Errorf("target %s: %v", r.target, r.err)
+			failed++
+			continue
+		}
+		s.MessageStats = append(s.MessageStats, r.stats...)
+		succeeded++
+	}
+
+	grpclog.Infof("fan-out complete: %d/%d targets succeeded", succeeded, succeeded+failed)
+
+	return s
+}
+
+// mergeSnapshotFiles loads and concatenates a set of local snapshot files,
+// tagging each file's Stats with a StatTag prefix of its base name, minus
+// the extension, and a "|" (e.g. "a|" for dir/a.gob), the same way
+// fetchFanout tags live targets, so listAllMessages can still group by
+// origin. A file that fails to load is skipped with an error logged rather
+// than aborting the whole merge.
+func mergeSnapshotFiles(files []string) *snapshot {
+	s := &snapshot{MessageStats: make([]*profiling.Stat, 0)}
+
+	for _, f := range files {
+		loaded, err := decodeSnapshotFile(f)
+		if err != nil {
+			grpclog.Errorf("skipping %s: %v", f, err)
+			continue
+		}
+
+		tag := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		for _, stat := range loaded.MessageStats {
+			stat.StatTag = tag + "|" + stat.StatTag
+		}
+
+		s.MessageStats = append(s.MessageStats, loaded.MessageStats...)
+	}
+
+	return s
+}
+
 func getTimerNano(timer *profiling.Timer) int64 {
 	return int64(timer.End.Sub(timer.Begin))
 }
@@ -161,16 +502,22 @@ func recursiveMessageStatList(cur *hierNode) {
 				fmt.Printf(" ")
 			}
 			var nano, childNano int64
+			var allocObjects, allocBytes uint64
 			for _, timer := range cur.childTimers {
 				childNano += getTimerNano(timer)
 			}
 			for _, timer := range cur.timers {
 				nano += getTimerNano(timer)
+				allocObjects += timer.AllocDelta
+				allocBytes += timer.BytesDelta
 			}
 			fmt.Printf("%d\t%d", nano, childNano)
 			if *showPercent {
 				fmt.Printf("\t~ %d%%", (100*childNano) / nano)
 			}
+			if allocObjects > 0 || allocBytes > 0 {
+				fmt.Printf("\t(alloc %d objs, %d bytes)", allocObjects, allocBytes)
+			}
 			fmt.Printf("\t @")
 			for i, timer := range cur.timers {
 				fmt.Printf("%s-%s", getTimerTimestamp(timer.Begin), getTimerTimestamp(timer.End))
@@ -219,8 +566,22 @@ func listMessageStat(stat *profiling.Stat) {
 	fmt.Printf("\n")
 }
 
+// targetPrefix returns the target that fetchFanout/mergeSnapshotFiles
+// prefix a StatTag with (the part before the first "|"), or "" if tag
+// carries no such prefix (e.g. a snapshot fetched from a single -address).
+func targetPrefix(tag string) string {
+	if idx := strings.Index(tag, "|"); idx >= 0 {
+		return tag[:idx]
+	}
+	return ""
+}
+
 func listAllMessages(stats []*profiling.Stat) {
 	sort.Slice(stats, func(i, j int) bool {
+		pi, pj := targetPrefix(stats[i].StatTag), targetPrefix(stats[j].StatTag)
+		if pi != pj {
+			return pi < pj
+		}
 		if len(stats[j].Timers) == 0 {
 			return true
 		} else if len(stats[i].Timers) == 0 {
@@ -235,29 +596,150 @@ func listAllMessages(stats []*profiling.Stat) {
 	}
 }
 
+func exportPprofFile(f string, stats []*profiling.Stat) {
+	grpclog.Infof("writing pprof profile to %s", f)
+	file, err := os.Create(f)
+	if err != nil {
+		grpclog.Errorf("cannot create %s: %v", f, err)
+		return
+	}
+	defer file.Close()
+
+	if err := proto.WriteProfile(file, stats); err != nil {
+		grpclog.Errorf("cannot write pprof profile to %s: %v", f, err)
+	}
+}
+
+func exportTraceFile(f string, stats []*profiling.Stat) {
+	grpclog.Infof("writing trace to %s", f)
+	file, err := os.Create(f)
+	if err != nil {
+		grpclog.Errorf("cannot create %s: %v", f, err)
+		return
+	}
+	defer file.Close()
+
+	if err := proto.WriteTraceEvents(file, stats); err != nil {
+		grpclog.Errorf("cannot write trace to %s: %v", f, err)
+	}
+}
+
+func exportOTLPToFile(f string, stats []*profiling.Stat) {
+	grpclog.Infof("writing OTLP spans to %s", f)
+	file, err := os.Create(f)
+	if err != nil {
+		grpclog.Errorf("cannot create %s: %v", f, err)
+		return
+	}
+	defer file.Close()
+
+	if err := proto.WriteOTLP(file, stats); err != nil {
+		grpclog.Errorf("cannot write OTLP spans to %s: %v", f, err)
+	}
+}
+
+func exportOTLPToCollector(endpoint string, stats []*profiling.Stat) {
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*timeout)*time.Second)
+		defer cancel()
+	}
+
+	grpclog.Infof("dialing OTLP collector %s", endpoint)
+	cc, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		grpclog.Errorf("dial error: %v", err)
+		return
+	}
+	defer cc.Close()
+
+	if err := proto.ExportOTLP(ctx, cc, stats); err != nil {
+		grpclog.Errorf("error exporting OTLP spans to %s: %v", endpoint, err)
+		return
+	}
+
+	grpclog.Infof("successfully exported OTLP spans for %d stat(s) to %s", len(stats), endpoint)
+}
+
 func process(s *snapshot) {
-	if *listAll {
-		listAllMessages(s.MessageStats)
-	} else if *listMessages {
+	acted := false
+
+	if *exportPprof != "" {
+		exportPprofFile(*exportPprof, s.MessageStats)
+		acted = true
+	}
+
+	if *exportTrace != "" {
+		exportTraceFile(*exportTrace, s.MessageStats)
+		acted = true
+	}
+
+	if *exportOTLPFile != "" {
+		exportOTLPToFile(*exportOTLPFile, s.MessageStats)
+		acted = true
+	}
+
+	if *exportOTLP != "" {
+		exportOTLPToCollector(*exportOTLP, s.MessageStats)
+		acted = true
+	}
+
+	if *listAll || *listMessages {
 		listAllMessages(s.MessageStats)
-	} else {
+		acted = true
+	}
+
+	if !acted {
 		fmt.Printf("no action specified\n")
 	}
 }
 
-func loadSnapshot(f string) {
-	grpclog.Infof("loading %s", f)
+// decodeSnapshotFile loads a local snapshot file written by either
+// writeSnapshotFile's "pb" or legacy "gob" format, auto-detecting which by
+// peeking at the file's first few bytes.
+func decodeSnapshotFile(f string) (*snapshot, error) {
 	file, err := os.Open(f)
 	if err != nil {
-		grpclog.Errorf("cannot open %s: %v", f, err)
-		return
+		return nil, fmt.Errorf("cannot open %s: %v", f, err)
+	}
+	defer file.Close()
+
+	// Peek at the first few bytes to tell a self-describing protobuf
+	// snapshot apart from a legacy gob one, then rewind before decoding for
+	// real; -format only controls what -store-snapshot writes.
+	peek := make([]byte, 8)
+	n, _ := file.Read(peek)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("cannot seek %s: %v", f, err)
 	}
 
 	s := &snapshot{}
 
-	decoder := gob.NewDecoder(file)
-	if err = decoder.Decode(s); err != nil {
-		grpclog.Errorf("cannot decode %s: %v", f, err)
+	if proto.IsSnapshotStream(peek[:n]) {
+		header, err := proto.ReadSnapshotStream(file, func(stat *profiling.Stat) error {
+			s.MessageStats = append(s.MessageStats, stat)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode %s: %v", f, err)
+		}
+		grpclog.Infof("loaded snapshot schema v%d for target %q (%d samples) from %s", header.SchemaVersion, header.Target, header.SampleCount, f)
+	} else {
+		grpclog.Infof("%s is not a protobuf snapshot; falling back to legacy gob format", f)
+		if err := gob.NewDecoder(file).Decode(s); err != nil {
+			return nil, fmt.Errorf("cannot decode %s: %v", f, err)
+		}
+	}
+
+	return s, nil
+}
+
+func loadSnapshot(f string) {
+	grpclog.Infof("loading %s", f)
+	s, err := decodeSnapshotFile(f)
+	if err != nil {
+		grpclog.Errorf("%v", err)
 		return
 	}
 
@@ -270,7 +752,8 @@ func main() {
 		return
 	}
 
-	if *address != "" {
+	switch {
+	case *address != "":
 		ctx := context.Background()
 		var cancel context.CancelFunc
 		if *timeout > 0 {
@@ -298,10 +781,57 @@ func main() {
 			return
 		}
 
+		if *setFilter != "" {
+			setFilterRules(ctx, c, *setFilter)
+			return
+		}
+
+		if *showFilter {
+			showFilterRules(ctx, c)
+			return
+		}
+
+		if *aggregate {
+			showAggregatedStats(ctx, c, *aggWindow, *aggPercentiles)
+			return
+		}
+
 		if *storeSnapshotFile != "" {
 			storeSnapshot(ctx, c, *storeSnapshotFile)
 		}
-	} else {
+
+		if *exportPprof != "" || *exportTrace != "" || *exportOTLP != "" || *exportOTLPFile != "" {
+			s, err := fetchSnapshot(ctx, c)
+			if err != nil {
+				grpclog.Errorf("%v", err)
+				return
+			}
+			process(s)
+		}
+
+	case *addresses != "" || *targetsFile != "":
+		targets, err := parseTargets()
+		if err != nil {
+			grpclog.Errorf("%v", err)
+			return
+		}
+
+		s := fetchFanout(context.Background(), targets)
+
+		if *storeSnapshotFile != "" {
+			grpclog.Infof("writing to %s in %s format", *storeSnapshotFile, *snapshotFormat)
+			if err := writeSnapshotFile(*storeSnapshotFile, strings.Join(targets, ","), s); err != nil {
+				grpclog.Errorf("%v", err)
+				return
+			}
+		}
+
+		process(s)
+
+	case *mergeSnapshotsFlag != "":
+		process(mergeSnapshotFiles(strings.Split(*mergeSnapshotsFlag, ",")))
+
+	default:
 		loadSnapshot(*loadSnapshotFile)
 	}
 }
@@ -1,8 +1,20 @@
 package metrics
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
+
+	// metrics shares profiling.CircularBuffer with the string-tag-based
+	// profiling package rather than maintaining a second ring buffer
+	// implementation. That's as far as the unification goes, though: Stat and
+	// Timer here are still their own types built around ptpb enums, distinct
+	// from profiling.Stat/profiling.Timer's free-form strings, and nothing
+	// actually drains MessageStats below -- profiling/service's
+	// GetMessageStats/GetStreamStats both drain profiling.StreamStats, so this
+	// package's buffer only fills if some other caller pushes into it and
+	// drains it itself.
+	"google.golang.org/grpc/profiling"
 	ptpb "google.golang.org/grpc/profiling/proto/tags"
 )
 
@@ -53,12 +65,12 @@ func (stat *Stat) NewTimer(timerTag ptpb.TimerTag) *Timer {
 	return timer
 }
 
-var MessageStats *CircularBuffer
+var MessageStats *profiling.CircularBuffer
 
 func InitStats(bufsize uint32) (err error) {
-	MessageStats, err = NewCircularBuffer(bufsize)
-	if err != nil {
-		return
+	MessageStats = profiling.NewCircularBuffer(bufsize)
+	if MessageStats == nil {
+		return fmt.Errorf("bufsize %d is not a power of two", bufsize)
 	}
 
 	return
@@ -0,0 +1,203 @@
+package proto
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"google.golang.org/grpc/internal/profiling"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+// otlpNode is one level of the `/`-delimited TimerTag hierarchy (the same
+// hierarchy newHierNode/recursiveMessageStatList render as an indented tree
+// and StatsToProfile turns into pprof stacks), kept around only long enough
+// to compute each level's span.
+type otlpNode struct {
+	segment string
+	path string
+
+	children []*otlpNode
+	childIndex map[string]int
+
+	spanID [8]byte
+	start time.Time
+	end time.Time
+	timed bool
+
+	// allocObjects/allocBytes sum every observed Timer's AllocDelta/BytesDelta
+	// at this node, so a span covering several alloc-tracked Timers (e.g. one
+	// per retry) still reports a total rather than just the last one seen.
+	allocObjects uint64
+	allocBytes uint64
+}
+
+func newOtlpNode(segment, path string) *otlpNode {
+	return &otlpNode{segment: segment, path: path, childIndex: make(map[string]int)}
+}
+
+func (n *otlpNode) child(segment string) *otlpNode {
+	if idx, ok := n.childIndex[segment]; ok {
+		return n.children[idx]
+	}
+
+	path := segment
+	if n.path != "" {
+		path = n.path + "/" + segment
+	}
+
+	c := newOtlpNode(segment, path)
+	n.childIndex[segment] = len(n.children)
+	n.children = append(n.children, c)
+	return c
+}
+
+func (n *otlpNode) observe(begin, end time.Time, allocObjects, allocBytes uint64) {
+	if !n.timed || begin.Before(n.start) {
+		n.start = begin
+	}
+	if !n.timed || end.After(n.end) {
+		n.end = end
+	}
+	n.timed = true
+
+	n.allocObjects += allocObjects
+	n.allocBytes += allocBytes
+}
+
+// propagate fills in start/end for nodes with no Timer of their own -- the
+// interior levels of the hierarchy -- from the range of their children, so
+// every level still renders as a span covering its descendants' lifetime.
+func (n *otlpNode) propagate() {
+	for _, c := range n.children {
+		c.propagate()
+		n.observe(c.start, c.end, c.allocObjects, c.allocBytes)
+	}
+}
+
+// buildOtlpTree turns a Stat's Timers into a tree keyed by `/`-delimited
+// TimerTag segments, with the root representing the Stat itself.
+func buildOtlpTree(stat *profiling.Stat) *otlpNode {
+	root := newOtlpNode(stat.StatTag, "")
+
+	for i := range stat.Timers {
+		timer := &stat.Timers[i]
+		cur := root
+		for _, seg := range strings.Split(timer.TimerTag, "/") {
+			cur = cur.child(seg)
+		}
+		cur.observe(timer.Begin, timer.End, timer.AllocDelta, timer.BytesDelta)
+	}
+
+	root.propagate()
+	return root
+}
+
+func (n *otlpNode) toSpan(traceID [16]byte, parentSpanID []byte) *tracepb.Span {
+	span := &tracepb.Span{
+		TraceId: traceID[:],
+		SpanId: n.spanID[:],
+		ParentSpanId: parentSpanID,
+		Name: n.segment,
+		StartTimeUnixNano: uint64(n.start.UnixNano()),
+		EndTimeUnixNano: uint64(n.end.UnixNano()),
+	}
+
+	// Only attach alloc attributes when this span (or one of its descendants,
+	// via propagate) actually observed an alloc-tracked Timer, the same
+	// omit-when-zero convention StatsToTraceEvents uses for Args.
+	if n.allocObjects > 0 || n.allocBytes > 0 {
+		span.Attributes = []*commonpb.KeyValue{
+			{Key: "alloc_objects", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(n.allocObjects)}}},
+			{Key: "alloc_bytes", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(n.allocBytes)}}},
+		}
+	}
+
+	return span
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	rand.Read(id[:])
+	return id
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	rand.Read(id[:])
+	return id
+}
+
+// toSpans flattens the tree into OTLP Spans, assigning every node -- root
+// included -- a fresh random SpanId and wiring ParentSpanId from its parent.
+func (n *otlpNode) toSpans(traceID [16]byte, parentSpanID []byte, out *[]*tracepb.Span) {
+	n.spanID = newSpanID()
+	*out = append(*out, n.toSpan(traceID, parentSpanID))
+	for _, c := range n.children {
+		c.toSpans(traceID, n.spanID[:], out)
+	}
+}
+
+// StatsToResourceSpans converts stats into OTLP ResourceSpans, one per Stat
+// with a non-empty Timer list: each Stat becomes its own trace, its StatTag
+// becomes the resource's service.name attribute, and each hierarchy level of
+// its Timers' TimerTags becomes a parented Span, with interior levels'
+// start/end inferred from their descendants (see otlpNode.propagate).
+func StatsToResourceSpans(stats []*profiling.Stat) []*tracepb.ResourceSpans {
+	var out []*tracepb.ResourceSpans
+
+	for _, stat := range stats {
+		if len(stat.Timers) == 0 {
+			continue
+		}
+
+		root := buildOtlpTree(stat)
+
+		var spans []*tracepb.Span
+		root.toSpans(newTraceID(), nil, &spans)
+
+		out = append(out, &tracepb.ResourceSpans{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{{
+					Key: "service.name",
+					Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: stat.StatTag}},
+				}},
+			},
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+		})
+	}
+
+	return out
+}
+
+// WriteOTLP writes stats to w as the JSON encoding of an OTLP
+// ExportTraceServiceRequest, for offline loading into any OTLP-JSON-capable
+// trace viewer.
+func WriteOTLP(w io.Writer, stats []*profiling.Stat) error {
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: StatsToResourceSpans(stats)}
+
+	b, err := protojson.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// ExportOTLP converts stats to OTLP spans and pushes them to the OTLP/gRPC
+// collector reachable over cc via the standard TraceService.Export RPC.
+func ExportOTLP(ctx context.Context, cc *grpc.ClientConn, stats []*profiling.Stat) error {
+	client := coltracepb.NewTraceServiceClient(cc)
+	_, err := client.Export(ctx, &coltracepb.ExportTraceServiceRequest{ResourceSpans: StatsToResourceSpans(stats)})
+	return err
+}
@@ -0,0 +1,92 @@
+package proto
+
+import (
+	"io"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"google.golang.org/grpc/internal/profiling"
+)
+
+// StatsToProfile aggregates stats into a single pprof profile.Profile,
+// treating each Timer's `/`-delimited TimerTag as a call stack -- the same
+// hierarchy listMessageStat renders as an indented tree -- and wall-clock
+// duration as the sample value. Function and location entries are deduped by
+// their full tag path, so that repeated timers (e.g. many RPCs hitting the
+// same code path) collapse into one flame instead of one stack per RPC, the
+// way `go tool pprof` and https://speedscope.app expect.
+//
+// Every sample carries all three SampleType values, not just "wall" -- a
+// pprof.Profile requires every Sample's Value slice to be the same length as
+// SampleType, so a Timer created with NewTimer or NewBlockTimer (which never
+// touch AllocDelta/BytesDelta) just contributes zeroes to the alloc columns
+// rather than omitting them.
+func StatsToProfile(stats []*profiling.Stat) *profile.Profile {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "wall", Unit: "nanoseconds"},
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_bytes", Unit: "bytes"},
+		},
+		PeriodType: &profile.ValueType{Type: "wall", Unit: "nanoseconds"},
+		Period: 1,
+	}
+
+	functions := make(map[string]*profile.Function)
+	locations := make(map[string]*profile.Location)
+
+	location := func(path, name string) *profile.Location {
+		if loc, ok := locations[path]; ok {
+			return loc
+		}
+
+		fn := &profile.Function{ID: uint64(len(functions)) + 1, Name: name}
+		functions[path] = fn
+		p.Function = append(p.Function, fn)
+
+		loc := &profile.Location{ID: uint64(len(locations)) + 1, Line: []profile.Line{{Function: fn}}}
+		locations[path] = loc
+		p.Location = append(p.Location, loc)
+
+		return loc
+	}
+
+	for _, stat := range stats {
+		for _, timer := range stat.Timers {
+			segments := strings.Split(timer.TimerTag, "/")
+
+			stack := make([]*profile.Location, len(segments))
+			path := ""
+			for i, seg := range segments {
+				if path == "" {
+					path = seg
+				} else {
+					path = path + "/" + seg
+				}
+				stack[i] = location(path, seg)
+			}
+
+			// pprof samples list their locations leaf-first.
+			for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+				stack[i], stack[j] = stack[j], stack[i]
+			}
+
+			p.Sample = append(p.Sample, &profile.Sample{
+				Location: stack,
+				Value: []int64{
+					int64(timer.End.Sub(timer.Begin)),
+					int64(timer.AllocDelta),
+					int64(timer.BytesDelta),
+				},
+			})
+		}
+	}
+
+	return p
+}
+
+// WriteProfile aggregates stats with StatsToProfile and writes the result to
+// w in gzip-compressed pprof wire format.
+func WriteProfile(w io.Writer, stats []*profiling.Stat) error {
+	return StatsToProfile(stats).Write(w)
+}
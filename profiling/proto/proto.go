@@ -6,6 +6,16 @@ import (
 	pspb "google.golang.org/grpc/profiling/proto/service"
 )
 
+// timerToTimerProto converts timer to wire form.
+//
+// TODO: timer.AllocDelta/BytesDelta aren't carried across, so a Stat that
+// went through a WriteSnapshotStream/ReadSnapshotStream or RPC round trip loses its
+// alloc-timer data even though StatsToProfile/StatsToTraceEvents/
+// StatsToResourceSpans (the in-process export paths, which work directly off
+// []*profiling.Stat) do carry it. Wiring this through means adding
+// AllocDelta/BytesDelta fields to pspb.TimerProto, which lives in the
+// profiling/proto/service package generated from service.proto -- this
+// checkout doesn't have that package, so the fields can't be added here.
 func timerToTimerProto(timer *profiling.Timer) *pspb.TimerProto {
 	return &pspb.TimerProto{
 		TimerTag: timer.TimerTag,
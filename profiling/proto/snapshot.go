@@ -0,0 +1,136 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/grpc/internal/profiling"
+	pspb "google.golang.org/grpc/profiling/proto/service"
+)
+
+// SnapshotSchemaVersion is written into every SnapshotHeaderProto produced by
+// WriteSnapshotStream. Bump it whenever a future change makes old readers
+// misinterpret new snapshots.
+const SnapshotSchemaVersion = 1
+
+// snapshotMagic identifies the streaming protobuf snapshot format, so that
+// loadSnapshot can tell it apart from a legacy encoding/gob snapshot by
+// looking at a file's first few bytes alone, without attempting to decode
+// either format first.
+var snapshotMagic = []byte("GRPCPROF")
+
+// NewSnapshotHeader builds the header record written once at the start of a
+// streaming snapshot, ahead of its StatProto records.
+func NewSnapshotHeader(target string, sampleCount int) *pspb.SnapshotHeaderProto {
+	return &pspb.SnapshotHeaderProto{
+		SchemaVersion: SnapshotSchemaVersion,
+		TimestampSec: time.Now().Unix(),
+		Target: target,
+		SampleCount: uint32(sampleCount),
+		BuildInfo: runtime.Version(),
+	}
+}
+
+// WriteSnapshotStream writes stats to w as a self-describing, length-prefixed
+// stream of protobuf messages: the magic bytes, a SnapshotHeaderProto, and
+// then one StatProto per stat. Unlike a single monolithic message, a reader
+// can consume this one record at a time via ReadSnapshotStream without
+// buffering the whole snapshot in memory first.
+func WriteSnapshotStream(w io.Writer, target string, stats []*profiling.Stat) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.Write(snapshotMagic); err != nil {
+		return fmt.Errorf("writing snapshot magic: %v", err)
+	}
+
+	if err := writeDelimited(bw, NewSnapshotHeader(target, len(stats))); err != nil {
+		return fmt.Errorf("writing snapshot header: %v", err)
+	}
+
+	for _, stat := range stats {
+		if err := writeDelimited(bw, StatToStatProto(stat)); err != nil {
+			return fmt.Errorf("writing stat: %v", err)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ReadSnapshotStream reads a stream written by WriteSnapshotStream, invoking
+// fn with each decoded Stat in turn rather than returning them all at once,
+// and returns the header once the stream is exhausted.
+func ReadSnapshotStream(r io.Reader, fn func(*profiling.Stat) error) (*pspb.SnapshotHeaderProto, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("reading snapshot magic: %v", err)
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return nil, fmt.Errorf("not a protobuf snapshot stream (magic mismatch)")
+	}
+
+	header := &pspb.SnapshotHeaderProto{}
+	if err := readDelimited(br, header); err != nil {
+		return nil, fmt.Errorf("reading snapshot header: %v", err)
+	}
+
+	for {
+		statProto := &pspb.StatProto{}
+		if err := readDelimited(br, statProto); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return header, fmt.Errorf("reading stat: %v", err)
+		}
+
+		if err := fn(StatProtoToStat(statProto)); err != nil {
+			return header, err
+		}
+	}
+
+	return header, nil
+}
+
+// IsSnapshotStream reports whether b -- typically a peek at a file's first
+// few bytes -- begins with the protobuf snapshot stream's magic, letting
+// callers distinguish it from a legacy gob snapshot before picking a decoder.
+func IsSnapshotStream(b []byte) bool {
+	return bytes.HasPrefix(b, snapshotMagic)
+}
+
+func writeDelimited(w io.Writer, m gproto.Message) error {
+	b, err := gproto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func readDelimited(r *bufio.Reader, m gproto.Message) error {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	return gproto.Unmarshal(b, m)
+}
@@ -0,0 +1,83 @@
+package proto
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc/internal/profiling"
+)
+
+// traceEvent is a single entry in Chrome's "trace event format", the JSON
+// array that chrome://tracing and Perfetto both load directly. Only the
+// fields StatsToTraceEvents populates are listed; the format has many more,
+// all optional.
+type traceEvent struct {
+	Name string `json:"name"`
+	Ph string `json:"ph"`
+	Ts float64 `json:"ts"`
+	Dur float64 `json:"dur"`
+	Pid int `json:"pid"`
+	Tid int `json:"tid"`
+	// Args carries a Timer's AllocDelta/BytesDelta, if any -- omitted
+	// entirely for the common wall-clock-only Timer rather than serialized
+	// as zeroes, since most events don't have them.
+	Args map[string]uint64 `json:"args,omitempty"`
+}
+
+// StatsToTraceEvents converts stats into one "X" (complete) duration event
+// per Timer, with Ts and Dur in microseconds as the trace event format
+// requires. Events are grouped into tracks by assigning each distinct
+// StatTag its own pid, and each distinct top-level TimerTag segment --
+// mirroring the first level of the hierarchy listMessageStat prints -- its
+// own tid, so that sibling timers under the same RPC line up in the same
+// row. Timers of different Stats that share a StatTag and a top-level
+// segment get the same pid and tid and so share a row.
+func StatsToTraceEvents(stats []*profiling.Stat) []traceEvent {
+	events := make([]traceEvent, 0)
+	pids := make(map[string]int)
+	tids := make(map[string]int)
+
+	for _, stat := range stats {
+		pid, ok := pids[stat.StatTag]
+		if !ok {
+			pid = len(pids)
+			pids[stat.StatTag] = pid
+		}
+
+		for _, timer := range stat.Timers {
+			top := strings.SplitN(timer.TimerTag, "/", 2)[0]
+			tid, ok := tids[top]
+			if !ok {
+				tid = len(tids)
+				tids[top] = tid
+			}
+
+			var args map[string]uint64
+			if timer.AllocDelta > 0 || timer.BytesDelta > 0 {
+				args = map[string]uint64{
+					"alloc_objects": timer.AllocDelta,
+					"alloc_bytes": timer.BytesDelta,
+				}
+			}
+
+			events = append(events, traceEvent{
+				Name: timer.TimerTag,
+				Ph: "X",
+				Ts: float64(timer.Begin.UnixNano()) / 1e3,
+				Dur: float64(timer.End.Sub(timer.Begin)) / 1e3,
+				Pid: pid,
+				Tid: tid,
+				Args: args,
+			})
+		}
+	}
+
+	return events
+}
+
+// WriteTraceEvents converts stats with StatsToTraceEvents and writes the
+// result to w as the JSON array chrome://tracing and Perfetto both accept.
+func WriteTraceEvents(w io.Writer, stats []*profiling.Stat) error {
+	return json.NewEncoder(w).Encode(StatsToTraceEvents(stats))
+}
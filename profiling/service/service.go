@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"time"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/grpclog"
 
@@ -30,7 +31,7 @@ func Init(pc *ProfilingConfig) (err error) {
 	registerService(pc.Server)
 
 	// Do this last after everything has been initialised and allocated.
-	profiling.SetEnabled(pc.Enabled)
+	profiling.Enable(pc.Enabled)
 
 	return
 }
@@ -39,21 +40,114 @@ type profilingServer struct {}
 
 func (s *profilingServer) SetEnabled(ctx context.Context, req *pspb.SetEnabledRequest) (ser *pspb.SetEnabledResponse, err error) {
 	grpclog.Infof("processing SetEnabled (%v)", req.Enabled)
-	profiling.SetEnabled(req.Enabled)
+	profiling.Enable(req.Enabled)
+
+	if len(req.Rules) > 0 {
+		rules := make([]profiling.FilterRule, len(req.Rules))
+		for i, r := range req.Rules {
+			rules[i] = ruleProtoToRule(r)
+		}
+		if err = profiling.SetFilterRules(rules); err != nil {
+			return nil, err
+		}
+	}
 
 	ser = &pspb.SetEnabledResponse{Success: true}
 	err = nil
 	return
 }
 
+// GetEnabledRules reports the per-service/method filter rules installed by
+// the most recent SetEnabled call that included Rules.
+func (s *profilingServer) GetEnabledRules(ctx context.Context, req *pspb.GetEnabledRulesRequest) (resp *pspb.GetEnabledRulesResponse, err error) {
+	grpclog.Infof("processing GetEnabledRules")
+
+	rules := profiling.FilterRules()
+	pbRules := make([]*pspb.FilterRule, len(rules))
+	for i, r := range rules {
+		pbRules[i] = ruleToRuleProto(r)
+	}
+
+	return &pspb.GetEnabledRulesResponse{Rules: pbRules}, nil
+}
+
+// ClearRules removes every active filter rule, reverting to the global
+// enabled/disabled switch for every service and method.
+func (s *profilingServer) ClearRules(ctx context.Context, req *pspb.ClearRulesRequest) (resp *pspb.ClearRulesResponse, err error) {
+	grpclog.Infof("processing ClearRules")
+	profiling.ClearFilterRules()
+	return &pspb.ClearRulesResponse{Success: true}, nil
+}
+
+func ruleProtoToRule(r *pspb.FilterRule) profiling.FilterRule {
+	return profiling.FilterRule{
+		Service: r.Service,
+		Method: r.Method,
+		Enabled: r.Enabled,
+		SampleRate: r.SampleRate,
+	}
+}
+
+func ruleToRuleProto(r profiling.FilterRule) *pspb.FilterRule {
+	return &pspb.FilterRule{
+		Service: r.Service,
+		Method: r.Method,
+		Enabled: r.Enabled,
+		SampleRate: r.SampleRate,
+	}
+}
+
+// GetAggregatedStats drains StreamStats and folds the result through a
+// profiling.MessageAggregator, returning per-(StatTag, TimerTag) summary
+// statistics and the requested percentiles over the trailing req.WindowSeconds
+// of samples, rather than the raw per-RPC Timers GetMessageStats and
+// GetStreamStats return. Like GetStreamStats, it does not pause profiling
+// while draining.
+func (s *profilingServer) GetAggregatedStats(ctx context.Context, req *pspb.GetAggregatedStatsRequest) (resp *pspb.GetAggregatedStatsResponse, err error) {
+	grpclog.Infof("processing GetAggregatedStats (window=%ds)", req.WindowSeconds)
+
+	results := profiling.StreamStats.Drain()
+	grpclog.Infof("aggregating %v records", len(results))
+
+	window := time.Duration(req.WindowSeconds) * time.Second
+	agg := profiling.NewMessageAggregator(window, profiling.DefaultAggregationGrace, profiling.DefaultAggregationDelay)
+
+	now := time.Now()
+	for _, r := range results {
+		agg.Observe(r.(*profiling.Stat), now)
+	}
+
+	resp = &pspb.GetAggregatedStatsResponse{Dropped: agg.Dropped.Load()}
+	for _, row := range agg.Snapshot(req.Percentiles) {
+		resp.Rows = append(resp.Rows, aggregatedStatToProto(row))
+	}
+
+	return resp, nil
+}
+
+func aggregatedStatToProto(row profiling.AggregatedStat) *pspb.AggregatedStatProto {
+	p := &pspb.AggregatedStatProto{
+		StatTag: row.StatTag,
+		TimerTag: row.TimerTag,
+		Count: row.Count,
+		SumNanos: row.SumNanos,
+		MinNanos: row.MinNanos,
+		MaxNanos: row.MaxNanos,
+	}
+	for percentile, value := range row.Percentiles {
+		p.Percentiles = append(p.Percentiles, &pspb.PercentileValue{Percentile: percentile, ValueNanos: value})
+	}
+	return p
+}
+
 func (s *profilingServer) GetMessageStats(req *pspb.GetMessageStatsRequest, stream pspb.Profiling_GetMessageStatsServer) (err error) {
 	grpclog.Infof("processing stream request for message stats")
-	results := profiling.MessageStats.Drain()
+	results := profiling.StreamStats.Drain()
 	grpclog.Infof("message stats size: %v records", len(results))
 
 	enabled := profiling.IsEnabled()
 	if enabled {
-		profiling.SetEnabled(false)
+		profiling.Enable(false)
 	}
 
 	for i := 0; i < len(results); i++ {
@@ -63,7 +157,28 @@ func (s *profilingServer) GetMessageStats(req *pspb.GetMessageStatsRequest, stre
 	}
 
 	if enabled {
-		profiling.SetEnabled(true)
+		profiling.Enable(true)
+	}
+
+	return
+}
+
+// GetStreamStats is a pull-based counterpart to GetMessageStats: instead of
+// requiring an operator to SSH in and inspect process memory, it drains
+// profiling.StreamStats directly and streams each Stat/Timer out as a
+// StatProto, the same way net/http/pprof lets you scrape a running process
+// over HTTP. Unlike GetMessageStats it does not pause profiling while
+// draining, since StreamStats is expected to be scraped repeatedly over the
+// lifetime of a server rather than captured once.
+func (s *profilingServer) GetStreamStats(req *pspb.GetStreamStatsRequest, stream pspb.Profiling_GetStreamStatsServer) (err error) {
+	grpclog.Infof("processing stream request for stream stats")
+	results := profiling.StreamStats.Drain()
+	grpclog.Infof("stream stats size: %v records", len(results))
+
+	for i := 0; i < len(results); i++ {
+		if err = stream.Send(ppb.StatToStatProto(results[i].(*profiling.Stat))); err != nil {
+			return
+		}
 	}
 
 	return